@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gnd.la/log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+var (
+	clusterEnabled    = flag.Bool("cluster", false, "enable cluster mode (HA leader election for Singleton services)")
+	clusterConfigFile = flag.String("cluster-config", "/etc/"+AppName+"/cluster.conf", "path to the top-level cluster mode config file (etcd endpoints and TLS creds)")
+)
+
+// ClusterConfig holds this daemon's cluster-mode settings: the etcd
+// endpoints to elect singleton-service leaders against, optional TLS
+// client credentials for talking to them, and the defaults for leader
+// election. Unlike a service's Config, it isn't one of the files under
+// *configDir; it's parsed by ParseClusterConfig from *clusterConfigFile,
+// a single top-level file shared by the whole daemon.
+type ClusterConfig struct {
+	Endpoints []string `json:"endpoints"`
+	TLSCert   string   `json:"tls_cert"`
+	TLSKey    string   `json:"tls_key"`
+	TLSCA     string   `json:"tls_ca"`
+	Prefix    string   `json:"prefix"`
+	TTL       int      `json:"ttl"` // seconds a leader lease is held before it must be renewed
+}
+
+func defaultClusterConfig() *ClusterConfig {
+	return &ClusterConfig{
+		Endpoints: []string{"http://127.0.0.1:4001"},
+		Prefix:    "/governator",
+		TTL:       10,
+	}
+}
+
+// ParseClusterConfig reads the cluster mode config file at path. A
+// missing file isn't an error - it just means run with defaultClusterConfig
+// (a single, unencrypted, local etcd).
+func ParseClusterConfig(path string) (*ClusterConfig, error) {
+	cfg := defaultClusterConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// newEtcdClient builds the etcd client described by cfg, using a TLS
+// client when any TLS credential is configured.
+func newEtcdClient(cfg *ClusterConfig) (*etcd.Client, error) {
+	if cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSCA != "" {
+		return etcd.NewTLSClient(cfg.Endpoints, cfg.TLSCert, cfg.TLSKey, cfg.TLSCA)
+	}
+	return etcd.NewClient(cfg.Endpoints), nil
+}
+
+// nodeID identifies this daemon to the rest of the cluster; it's used as
+// the value stored under each singleton service's leader key.
+var nodeID = clusterNodeID()
+
+func clusterNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// owners tracks, for every Singleton service known to this node, which
+// node currently holds its leader lease. It's updated by startCluster and
+// read by the "list" command so operators can see where each singleton is
+// actually running.
+var owners struct {
+	sync.Mutex
+	m map[string]string
+}
+
+func ownerOf(name string) (string, bool) {
+	owners.Lock()
+	defer owners.Unlock()
+	owner, ok := owners.m[name]
+	return owner, ok
+}
+
+// startCluster is the "cluster" supervisor subsystem alongside
+// startWatching/startServer/startHTTPServer. When *clusterEnabled is set,
+// it campaigns for leadership of every Singleton service against etcd: the
+// node holding a service's lease actually runs it, while the rest keep
+// their parsed config hot and take over as soon as the lease expires.
+func startCluster(ctx context.Context) error {
+	if !*clusterEnabled {
+		<-ctx.Done()
+		return nil
+	}
+	cfg, err := ParseClusterConfig(*clusterConfigFile)
+	if err != nil {
+		return err
+	}
+	client, err := newEtcdClient(cfg)
+	if err != nil {
+		return fmt.Errorf("error connecting to etcd: %s", err)
+	}
+	owners.Lock()
+	owners.m = make(map[string]string)
+	owners.Unlock()
+
+	var wg sync.WaitGroup
+	started := make(map[string]bool)
+	for {
+		services.Lock()
+		list := append([]*Service{}, services.list...)
+		services.Unlock()
+		for _, s := range list {
+			if !s.Config.Singleton || started[s.Name()] {
+				continue
+			}
+			started[s.Name()] = true
+			wg.Add(1)
+			go func(s *Service) {
+				defer wg.Done()
+				campaignFor(ctx, client, cfg, s)
+			}(s)
+		}
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// campaignFor repeatedly tries to acquire s's leader key, running s only
+// while this node holds the lease, until ctx is canceled.
+func campaignFor(ctx context.Context, client *etcd.Client, cfg *ClusterConfig, s *Service) {
+	key := fmt.Sprintf("%s/singletons/%s/leader", cfg.Prefix, s.Name())
+	leading := false
+	// Each leadership tenure gets its own monitorHealth goroutine via the
+	// shared healthCancels registry (see health.go), so winning or losing
+	// the lease again - or the service being removed entirely - always
+	// cancels the previous tenure's monitor instead of leaking it
+	defer func() {
+		cancelHealthMonitor(s.Name())
+		if leading {
+			client.CompareAndDelete(key, nodeID, 0)
+			s.Stop()
+		}
+	}()
+	for {
+		if !leading {
+			if _, err := client.Create(key, nodeID, uint64(cfg.TTL)); err == nil {
+				leading = true
+				log.Debugf("%s became leader for singleton service %s", nodeID, s.Name())
+				s.Start()
+				startHealthMonitor(ctx, s)
+			}
+		} else {
+			if _, err := client.CompareAndSwap(key, nodeID, uint64(cfg.TTL), nodeID, 0); err != nil {
+				log.Errorf("lost leadership of singleton service %s: %s", s.Name(), err)
+				leading = false
+				cancelHealthMonitor(s.Name())
+				s.Stop()
+			}
+		}
+		if resp, err := client.Get(key, false, false); err == nil && resp.Node != nil {
+			owners.Lock()
+			owners.m[s.Name()] = resp.Node.Value
+			owners.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(cfg.TTL) * time.Second / 2):
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"code.google.com/p/go.exp/fsnotify"
+	"context"
 	"errors"
 	"fmt"
 	"gnd.la/log"
@@ -30,99 +31,107 @@ func (s servicesByPriority) Less(i, j int) bool { return s[i].Config.Priority <
 func (s servicesByPriority) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s servicesByPriority) Sort()              { sort.Stable(s) }
 
-type quit struct {
-	stop    chan bool
-	stopped chan bool
-}
-
-func newQuit() *quit {
-	return &quit{
-		stop:    make(chan bool, 1),
-		stopped: make(chan bool, 1),
-	}
-}
-
-func (q *quit) sendStop() {
-	q.stop <- true
-}
-
-func (q *quit) sendStopped() {
-	q.stopped <- true
-}
-
-func startWatching(q *quit) error {
+// startWatching watches *configDir for changes, keeping the services list
+// in sync. It blocks until ctx is canceled, at which point it closes the
+// watcher and returns.
+func startWatching(ctx context.Context) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
 	}
+	if err := watcher.Watch(*configDir); err != nil {
+		watcher.Close()
+		return err
+	}
 	go func() {
-	End:
-		for {
-			select {
-			case ev := <-watcher.Event:
-				name := filepath.Base(ev.Name)
-				if shouldIgnoreFile(name) {
+		<-ctx.Done()
+		watcher.Close()
+	}()
+	for {
+		select {
+		case ev, ok := <-watcher.Event:
+			if !ok {
+				// the watcher was closed because ctx was canceled
+				return nil
+			}
+			name := filepath.Base(ev.Name)
+			if shouldIgnoreFile(name) {
+				break
+			}
+			services.Lock()
+			switch {
+			case ev.IsCreate():
+				cfg := ParseConfig(name)
+				log.Debugf("added service %s", cfg.ServiceName())
+				s := newService(cfg)
+				services.list = append(services.list, s)
+				if err := reorderServices(); err != nil {
+					log.Errorf("error computing start order: %s", err)
+				}
+				if *clusterEnabled && s.Config.Singleton {
+					// left to the "cluster" subsystem, which only starts
+					// Singleton services on the node that wins their
+					// leader election
 					break
 				}
-				services.Lock()
-				switch {
-				case ev.IsCreate():
-					cfg := ParseConfig(name)
-					log.Debugf("added service %s", cfg.ServiceName())
-					s := newService(cfg)
-					services.list = append(services.list, s)
-					servicesByPriority(services.list).Sort()
-					s.Start()
-				case ev.IsDelete() || ev.IsRename():
-					for ii := range services.list {
-						s := services.list[ii]
-						if s.Config.File == name {
-							log.Debugf("removed service %s", s.Name())
-							if s.State == StateStarted {
-								s.Stop()
-							}
-							services.list = append(services.list[:ii], services.list[ii+1:]...)
-							break
+				s.Start()
+				startHealthMonitor(ctx, s)
+			case ev.IsDelete() || ev.IsRename():
+				for ii := range services.list {
+					s := services.list[ii]
+					if s.Config.File == name {
+						log.Debugf("removed service %s", s.Name())
+						if s.State == StateStarted {
+							s.Stop()
 						}
+						cancelHealthMonitor(s.Name())
+						if err := s.logger.Close(); err != nil {
+							log.Errorf("error closing log sink for %s: %s", s.Name(), err)
+						}
+						services.list = append(services.list[:ii], services.list[ii+1:]...)
+						break
 					}
-				case ev.IsModify():
-					for _, v := range services.list {
-						if v.Config.File == name {
-							cfg := ParseConfig(name)
-							if reflect.DeepEqual(v.Config, cfg) {
-								// there were changes to the file which don't affect the conf
-								break
-							}
-							log.Debugf("changed service %s's configuration", v.Name())
-							start := false
-							if v.State == StateStarted {
-								start = v.Stop() == nil
-							}
-							v.Config = cfg
-							servicesByPriority(services.list).Sort()
-							if start {
-								v.Start()
-							}
+				}
+			case ev.IsModify():
+				for _, v := range services.list {
+					if v.Config.File == name {
+						cfg := ParseConfig(name)
+						if reflect.DeepEqual(v.Config, cfg) {
+							// there were changes to the file which don't affect the conf
 							break
 						}
+						log.Debugf("changed service %s's configuration", v.Name())
+						start := false
+						if v.State == StateStarted {
+							start = v.Stop() == nil
+						}
+						v.Config = cfg
+						if err := reorderServices(); err != nil {
+							log.Errorf("error computing start order: %s", err)
+						}
+						if start {
+							// v.State was only StateStarted here if this
+							// node actually had it running - for a
+							// Singleton service in cluster mode, that
+							// only holds on the node currently leading it,
+							// so this naturally restarts it there and
+							// leaves followers alone
+							v.Start()
+							startHealthMonitor(ctx, v)
+						}
+						break
 					}
-				default:
-					log.Errorf("unhandled event: %s\n", ev)
 				}
-				services.Unlock()
-			case err := <-watcher.Error:
-				log.Errorf("error watching: %s", err)
-			case <-q.stop:
-				watcher.Close()
-				q.sendStopped()
-				break End
+			default:
+				log.Errorf("unhandled event: %s\n", ev)
 			}
+			services.Unlock()
+		case err := <-watcher.Error:
+			log.Errorf("error watching: %s", err)
+		case <-ctx.Done():
+			return nil
 		}
-	}()
-	if err := watcher.Watch(*configDir); err != nil {
-		return err
 	}
-	return nil
 }
 
 func startService(conn net.Conn, s *Service) error {
@@ -153,9 +162,13 @@ func serveConn(conn net.Conn) error {
 		var err error
 		var st *Service
 		var name string
+		var withDeps bool
 		cmd := strings.ToLower(args[0])
 		if cmd == "start" || cmd == "stop" || cmd == "restart" || cmd == "log" {
-			if len(args) != 2 {
+			switch {
+			case len(args) == 3 && (cmd == "stop" || cmd == "restart") && args[2] == "--with-deps":
+				withDeps = true
+			case len(args) != 2:
 				err = encodeResponse(conn, respErr, fmt.Sprintf("command %s requires exactly one argument\n", cmd))
 				cmd = ""
 			}
@@ -185,12 +198,38 @@ func serveConn(conn net.Conn) error {
 				err = startService(conn, st)
 			}
 		case "stop":
+			services.Lock()
+			deps := dependents(name, services.list)
+			services.Unlock()
+			if withDeps {
+				// dependents() returns nearest-first (e.g. [app, nginx] for
+				// db); stop furthest-first so nginx goes down before the
+				// app it requires, and app before the target itself
+				for ii := len(deps) - 1; ii >= 0; ii-- {
+					if d := deps[ii]; d.State == StateStarted {
+						stopService(conn, d)
+					}
+				}
+			}
 			if st.State != StateStarted {
 				err = encodeResponse(conn, respErr, fmt.Sprintf("%s is not running\n", name))
 			} else {
 				_, err = stopService(conn, st)
 			}
 		case "restart":
+			services.Lock()
+			deps := dependents(name, services.list)
+			services.Unlock()
+			var stoppedDeps []*Service
+			if withDeps {
+				for ii := len(deps) - 1; ii >= 0; ii-- {
+					if d := deps[ii]; d.State == StateStarted {
+						if _, serr := stopService(conn, d); serr == nil {
+							stoppedDeps = append(stoppedDeps, d)
+						}
+					}
+				}
+			}
 			var stopped bool
 			if st.State == StateStarted {
 				stopped, err = stopService(conn, st)
@@ -198,6 +237,38 @@ func serveConn(conn net.Conn) error {
 			if stopped {
 				err = startService(conn, st)
 			}
+			// Only bring back the dependents this command actually
+			// stopped, and only once the target itself is back up;
+			// stoppedDeps is furthest-first, so reverse it to start
+			// nearest-first (app before nginx, which requires it)
+			if withDeps && st.State == StateStarted {
+				for ii := len(stoppedDeps) - 1; ii >= 0; ii-- {
+					startService(conn, stoppedDeps[ii])
+				}
+			}
+		case "reload":
+			configs, cerr := ParseConfigs()
+			if cerr != nil {
+				err = encodeResponse(conn, respErr, fmt.Sprintf("error reloading configuration: %s\n", cerr))
+				break
+			}
+			services.Lock()
+			byFile := make(map[string]*Config, len(configs))
+			for _, cfg := range configs {
+				byFile[cfg.File] = cfg
+			}
+			for _, v := range services.list {
+				if cfg, ok := byFile[v.Config.File]; ok {
+					v.Config = cfg
+				}
+			}
+			rerr := reorderServices()
+			services.Unlock()
+			if rerr != nil {
+				err = encodeResponse(conn, respErr, fmt.Sprintf("error reloading configuration: %s\n", rerr))
+				break
+			}
+			err = encodeResponse(conn, respOk, "reloaded\n")
 		case "list":
 			var buf bytes.Buffer
 			w := tabwriter.NewWriter(&buf, 4, 4, 4, ' ', 0)
@@ -220,9 +291,18 @@ func serveConn(conn net.Conn) error {
 					}
 				case StateFailed:
 					fmt.Fprintf(w, "FAILED - %s", v.Err)
+				case StateUnhealthy:
+					fmt.Fprintf(w, "UNHEALTHY since %s - %d restarts", formatTime(v.Started), v.Restarts)
 				default:
 					panic("invalid state")
 				}
+				if v.Config.Singleton {
+					if owner, ok := ownerOf(v.Name()); ok {
+						fmt.Fprintf(w, " - owned by %s", owner)
+					} else {
+						fmt.Fprint(w, " - no leader yet")
+					}
+				}
 				fmt.Fprint(w, "\t\n")
 			}
 			services.Unlock()
@@ -234,12 +314,8 @@ func serveConn(conn net.Conn) error {
 				err = encodeResponse(conn, respErr, fmt.Sprintf("%s is not running\n", name))
 				break
 			}
-			if st.logger.monitor != nil {
-				err = encodeResponse(conn, respErr, fmt.Sprintf("%s is already being monitored\n", name))
-				break
-			}
 			ch := make(chan bool, 1)
-			st.logger.monitor = func(prefix string, b []byte) {
+			attached := st.logger.attachMonitor(func(prefix string, b []byte) {
 				var buf bytes.Buffer
 				buf.WriteByte('[')
 				buf.WriteString(prefix)
@@ -249,6 +325,10 @@ func serveConn(conn net.Conn) error {
 					buf.Write(newLine)
 				}
 				encodeResponse(conn, respOk, buf.String())
+			})
+			if !attached {
+				err = encodeResponse(conn, respErr, fmt.Sprintf("%s is already being monitored\n", name))
+				break
 			}
 			go func() {
 				// log stops when the client sends something over the connection
@@ -259,7 +339,7 @@ func serveConn(conn net.Conn) error {
 				ch <- true
 			}()
 			<-ch
-			st.logger.monitor = nil
+			st.logger.detachMonitor()
 			return nil
 		default:
 			err = encodeResponse(conn, respErr, fmt.Sprintf("unknown command %s - %s\n", cmd, help))
@@ -271,7 +351,11 @@ func serveConn(conn net.Conn) error {
 	return encodeResponse(conn, respEnd, "")
 }
 
-func startServer(q *quit) error {
+// startServer serves the Unix-socket line protocol. It blocks until ctx is
+// canceled: the listener is closed in response, which unblocks Accept
+// instead of leaving it spinning on a closed-listener error, and every
+// spawned serveConn goroutine is waited on before startServer returns.
+func startServer(ctx context.Context) error {
 	os.Remove(SocketPath)
 	server, err := net.Listen("unix", SocketPath)
 	if err != nil {
@@ -281,32 +365,48 @@ func startServer(q *quit) error {
 		os.Chown(SocketPath, 0, gid)
 		os.Chmod(SocketPath, 0775)
 	}
-	conns := make(chan net.Conn, 10)
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]bool)
 	go func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				log.Errorf("error accepting connection: %s", err)
-			}
-			conns <- conn
+		<-ctx.Done()
+		server.Close()
+		// Close every connection handed to serveConn so far too, since
+		// commands like "log" block in conn.Read until the client writes
+		// or disconnects and would otherwise never let wg.Wait() return
+		connsMu.Lock()
+		for c := range conns {
+			c.Close()
 		}
+		connsMu.Unlock()
 	}()
-	go func() {
-		for {
-			select {
-			case <-q.stop:
-				os.Remove(SocketPath)
-				q.sendStopped()
-				return
-			case conn := <-conns:
-				go func() {
-					if err := serveConn(conn); err != nil {
-						log.Errorf("error serving connection: %s", err)
-					}
-				}()
+	var wg sync.WaitGroup
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
 			}
+			log.Errorf("error accepting connection: %s", err)
+			continue
 		}
-	}()
+		connsMu.Lock()
+		conns[conn] = true
+		connsMu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+			}()
+			if err := serveConn(conn); err != nil {
+				log.Errorf("error serving connection: %s", err)
+			}
+		}()
+	}
+	os.Remove(SocketPath)
+	wg.Wait()
 	return nil
 }
 
@@ -324,32 +424,43 @@ func daemonMain() error {
 	if err != nil {
 		return err
 	}
+	sup := newSupervisor()
 	services.Lock()
 	services.list = make([]*Service, len(configs))
 	for ii, v := range configs {
-		s := newService(v)
-		services.list[ii] = s
-		s.Start()
+		services.list[ii] = newService(v)
 	}
-	servicesByPriority(services.list).Sort()
-	services.Unlock()
-	quitWatcher := newQuit()
-	if err := startWatching(quitWatcher); err != nil {
-		log.Errorf("error watching %s, configuration won't be automatically updated: %s", *configDir, err)
+	if err := reorderServices(); err != nil {
+		log.Errorf("error computing start order, falling back to priority order: %s", err)
 	}
-	quitServer := newQuit()
-	if err := startServer(quitServer); err != nil {
-		log.Errorf("error starting server, can't receive remote commands: %s", err)
+	// Start in dependency order, so a service only starts once everything
+	// it Requires or comes After is already StateStarted. Singleton
+	// services are left to the "cluster" subsystem below, which only
+	// starts them on the node that wins their leader election.
+	for _, s := range services.list {
+		if *clusterEnabled && s.Config.Singleton {
+			continue
+		}
+		s.Start()
+		startHealthMonitor(sup.ctx, s)
 	}
+	services.Unlock()
+	sup.add("watcher", func(ctx context.Context) error {
+		if err := startWatching(ctx); err != nil {
+			log.Errorf("error watching %s, configuration won't be automatically updated: %s", *configDir, err)
+			<-ctx.Done()
+		}
+		return nil
+	})
+	sup.add("server", startServer)
+	sup.add("http", startHTTPServer)
+	sup.add("cluster", startCluster)
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, os.Kill)
 	// Wait for signal
 	<-c
-	quitWatcher.sendStop()
-	quitServer.sendStop()
-	// Wait for goroutines to exit cleanly
-	<-quitWatcher.stopped
-	<-quitServer.stopped
+	// Cancel every subsystem and wait for them all to exit cleanly
+	sup.stop()
 	services.Lock()
 	var wg sync.WaitGroup
 	wg.Add(len(services.list))
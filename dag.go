@@ -0,0 +1,141 @@
+package main
+
+// dependencyGraph resolves the Requires/After edges declared on each
+// service's Config into a deterministic start order, and answers
+// "who depends on this service" queries used to cascade stop/restart.
+type dependencyGraph struct {
+	byName map[string]*Service
+	edges  map[string][]string // service name -> names it must start after
+}
+
+func newDependencyGraph(list []*Service) *dependencyGraph {
+	g := &dependencyGraph{
+		byName: make(map[string]*Service, len(list)),
+		edges:  make(map[string][]string, len(list)),
+	}
+	for _, s := range list {
+		name := s.Name()
+		g.byName[name] = s
+		var deps []string
+		deps = append(deps, s.Config.Requires...)
+		deps = append(deps, s.Config.After...)
+		g.edges[name] = deps
+	}
+	return g
+}
+
+// cycleError is returned by topoOrder when the dependency graph contains
+// a cycle; Cycle holds the offending service names in order.
+type cycleError struct {
+	Cycle []string
+}
+
+func (e *cycleError) Error() string {
+	s := "dependency cycle detected:"
+	for _, n := range e.Cycle {
+		s += " " + n + " ->"
+	}
+	return s + " " + e.Cycle[0]
+}
+
+const (
+	unvisited = iota
+	visiting
+	visited
+)
+
+// topoOrder returns list reordered so that every service appears after
+// everything it Requires or is configured to start After, breaking ties
+// with the existing (priority-sorted) relative order. It replaces the old
+// flat priority sort with a real dependency order.
+func topoOrder(list []*Service) ([]*Service, error) {
+	g := newDependencyGraph(list)
+	state := make(map[string]int, len(list))
+	ordered := make([]*Service, 0, len(list))
+	var stack []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for ii, n := range stack {
+				if n == name {
+					start = ii
+					break
+				}
+			}
+			cycle := append([]string{}, stack[start:]...)
+			return &cycleError{Cycle: cycle}
+		}
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range g.edges[name] {
+			if _, ok := g.byName[dep]; !ok {
+				// dependency on a service that doesn't exist (yet); ignore it,
+				// it'll simply never gate this one's start order
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		if s := g.byName[name]; s != nil {
+			ordered = append(ordered, s)
+		}
+		return nil
+	}
+
+	for _, s := range list {
+		if err := visit(s.Name()); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// reorderServices replaces services.list (which callers must already hold
+// services.Lock for) with its dependency order, falling back to the
+// existing priority-sorted order and reporting err if a cycle is found.
+func reorderServices() error {
+	servicesByPriority(services.list).Sort()
+	ordered, err := topoOrder(services.list)
+	if err != nil {
+		return err
+	}
+	services.list = ordered
+	return nil
+}
+
+// dependents returns every service that directly or transitively Requires
+// or comes After name, in the order a depth-first walk outward from name
+// finds them: nearest first, each one before the dependents found through
+// it (for db <- app <- nginx, dependents of db are [app, nginx]).
+func dependents(name string, list []*Service) []*Service {
+	g := newDependencyGraph(list)
+	visited := map[string]bool{}
+	var result []*Service
+	var visit func(n string)
+	visit = func(n string) {
+		for _, s := range list {
+			sn := s.Name()
+			if visited[sn] {
+				continue
+			}
+			for _, dep := range g.edges[sn] {
+				if dep == n {
+					visited[sn] = true
+					result = append(result, s)
+					visit(sn)
+					break
+				}
+			}
+		}
+	}
+	visit(name)
+	return result
+}
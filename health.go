@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gnd.la/log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// StateUnhealthy is entered when a service's HealthCheck has failed
+// FailureThreshold times in a row while it was StateStarted.
+const StateUnhealthy = StateFailed + 1
+
+// HealthCheckConfig describes how to probe a running service. Exactly one
+// of TCP, HTTP or Exec should be set. It's parsed by ParseConfig from the
+// service's configuration file.
+type HealthCheckConfig struct {
+	TCP              string // "host:port" to dial
+	HTTP             string // URL expected to respond with a 2xx status
+	Exec             string // shell command expected to exit 0
+	Interval         time.Duration
+	Timeout          time.Duration
+	StartPeriod      time.Duration // grace period after start before checks count
+	FailureThreshold int
+}
+
+// RestartPolicy controls what happens to a service once it's marked
+// StateUnhealthy.
+type RestartPolicy struct {
+	Policy     string // "always", "on-failure" (default) or "unless-stopped"
+	MaxRetries int    // 0 means unlimited
+}
+
+func (hc *HealthCheckConfig) probe() error {
+	switch {
+	case hc.TCP != "":
+		conn, err := net.DialTimeout("tcp", hc.TCP, hc.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case hc.HTTP != "":
+		client := &http.Client{Timeout: hc.Timeout}
+		resp, err := client.Get(hc.HTTP)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	case hc.Exec != "":
+		ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+		defer cancel()
+		return exec.CommandContext(ctx, "sh", "-c", hc.Exec).Run()
+	}
+	return nil
+}
+
+// healthCancels tracks the cancel function for each service's running
+// monitorHealth goroutine, keyed by service name, so it can be stopped
+// when the service is removed instead of leaking for the rest of the
+// process's life.
+var healthCancels struct {
+	sync.Mutex
+	m map[string]context.CancelFunc
+}
+
+// startHealthMonitor launches monitorHealth for s under its own context
+// derived from parent, canceling (and replacing) any previous monitor
+// already running for the same service name.
+func startHealthMonitor(parent context.Context, s *Service) {
+	cancelHealthMonitor(s.Name())
+	ctx, cancel := context.WithCancel(parent)
+	healthCancels.Lock()
+	if healthCancels.m == nil {
+		healthCancels.m = make(map[string]context.CancelFunc)
+	}
+	healthCancels.m[s.Name()] = cancel
+	healthCancels.Unlock()
+	go monitorHealth(ctx, s)
+}
+
+// cancelHealthMonitor stops the health monitor goroutine for the named
+// service, if one is running. Call it when a service is removed, so its
+// monitorHealth goroutine doesn't outlive it.
+func cancelHealthMonitor(name string) {
+	healthCancels.Lock()
+	cancel, ok := healthCancels.m[name]
+	delete(healthCancels.m, name)
+	healthCancels.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// monitorHealth probes s's HealthCheck (if any) on Interval once
+// StartPeriod has elapsed, transitioning s to StateUnhealthy and applying
+// its RestartPolicy after FailureThreshold consecutive failures. It
+// returns at once if s has no HealthCheck configured when it starts, and
+// otherwise once ctx is canceled; the HealthCheck is read only once, at
+// that start.
+func monitorHealth(ctx context.Context, s *Service) {
+	hc := s.Config.HealthCheck
+	if hc == nil {
+		return
+	}
+	if hc.StartPeriod > 0 {
+		select {
+		case <-time.After(hc.StartPeriod):
+		case <-ctx.Done():
+			return
+		}
+	}
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			services.Lock()
+			state := s.State
+			services.Unlock()
+			if state != StateStarted && state != StateUnhealthy {
+				continue
+			}
+			if err := hc.probe(); err != nil {
+				failures++
+				log.Errorf("health check failed for %s (%d/%d): %s", s.Name(), failures, hc.FailureThreshold, err)
+				if failures >= hc.FailureThreshold {
+					services.Lock()
+					s.State = StateUnhealthy
+					services.Unlock()
+					applyRestartPolicy(s)
+					failures = 0
+				}
+			} else {
+				failures = 0
+			}
+		}
+	}
+}
+
+// applyRestartPolicy reacts to s having just been marked StateUnhealthy,
+// following its configured RestartPolicy. "unless-stopped" leaves the
+// service unhealthy until an operator intervenes; "always" and
+// "on-failure" (the default) stop and restart it, retrying with
+// exponential backoff up to MaxRetries.
+func applyRestartPolicy(s *Service) {
+	policy := s.Config.RestartPolicy
+	if policy != nil && policy.Policy == "unless-stopped" {
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; policy == nil || policy.MaxRetries <= 0 || attempt < policy.MaxRetries; attempt++ {
+		if err := s.Stop(); err != nil {
+			log.Errorf("error stopping unhealthy service %s: %s", s.Name(), err)
+		}
+		if err := s.Start(); err != nil {
+			log.Errorf("error restarting unhealthy service %s: %s", s.Name(), err)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		return
+	}
+	log.Errorf("giving up restarting unhealthy service %s", s.Name())
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gnd.la/log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+var (
+	httpAddr    = flag.String("http-addr", "", "address to listen on for the HTTP control API (disabled if empty)")
+	httpTLSCert = flag.String("http-tls-cert", "", "TLS certificate file for the HTTP control API")
+	httpTLSKey  = flag.String("http-tls-key", "", "TLS key file for the HTTP control API")
+)
+
+// serviceStatus is the JSON representation of a Service returned by the
+// HTTP control API.
+type serviceStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Restarts int    `json:"restarts"`
+	Error    string `json:"error,omitempty"`
+	Owner    string `json:"owner,omitempty"`
+}
+
+func stateString(st int) string {
+	switch st {
+	case StateStopped:
+		return "stopped"
+	case StateStopping:
+		return "stopping"
+	case StateStarting:
+		return "starting"
+	case StateStarted:
+		return "started"
+	case StateFailed:
+		return "failed"
+	case StateUnhealthy:
+		return "unhealthy"
+	}
+	return "unknown"
+}
+
+func newServiceStatus(s *Service) *serviceStatus {
+	st := &serviceStatus{
+		Name:     s.Name(),
+		State:    stateString(s.State),
+		Restarts: s.Restarts,
+	}
+	if s.Err != nil {
+		st.Error = s.Err.Error()
+	}
+	if s.Config.Singleton {
+		if owner, ok := ownerOf(s.Name()); ok {
+			st.Owner = owner
+		}
+	}
+	return st
+}
+
+func findServiceByName(name string) *Service {
+	services.Lock()
+	defer services.Unlock()
+	for _, v := range services.list {
+		if v.Name() == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func handleServices(w http.ResponseWriter, r *http.Request) {
+	services.Lock()
+	list := make([]*serviceStatus, len(services.list))
+	for ii, v := range services.list {
+		list[ii] = newServiceStatus(v)
+	}
+	services.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleService dispatches GET /services/{name}, POST /services/{name}/start,
+// POST /services/{name}/stop, POST /services/{name}/restart and the
+// GET /services/{name}/log WebSocket endpoint.
+func handleService(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/services/")
+	parts := strings.SplitN(rest, "/", 2)
+	name := parts[0]
+	s := findServiceByName(name)
+	if s == nil {
+		httpError(w, http.StatusNotFound, fmt.Errorf("no service named %s", name))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, newServiceStatus(s))
+		return
+	}
+	switch parts[1] {
+	case "log":
+		websocket.Handler(func(ws *websocket.Conn) {
+			serveServiceLogWS(ws, s)
+		}).ServeHTTP(w, r)
+	case "start":
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("start requires POST"))
+			return
+		}
+		if err := s.Start(); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newServiceStatus(s))
+	case "stop":
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("stop requires POST"))
+			return
+		}
+		if err := s.Stop(); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newServiceStatus(s))
+	case "restart":
+		if r.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, fmt.Errorf("restart requires POST"))
+			return
+		}
+		if s.State == StateStarted {
+			if err := s.Stop(); err != nil {
+				httpError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
+		if err := s.Start(); err != nil {
+			httpError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, newServiceStatus(s))
+	default:
+		httpError(w, http.StatusNotFound, fmt.Errorf("unknown action %s", parts[1]))
+	}
+}
+
+// logFrame is a single line of service output, as sent over the
+// /services/{name}/log WebSocket.
+type logFrame struct {
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+// serveServiceLogWS streams s's stdout/stderr to ws as JSON frames, reusing
+// the same monitor hook serveConn installs for the "log" line-protocol
+// command.
+func serveServiceLogWS(ws *websocket.Conn, s *Service) {
+	defer ws.Close()
+	done := make(chan bool, 1)
+	attached := s.logger.attachMonitor(func(prefix string, b []byte) {
+		line := strings.TrimRight(string(b), "\n")
+		if err := websocket.JSON.Send(ws, &logFrame{Stream: prefix, Line: line}); err != nil {
+			select {
+			case done <- true:
+			default:
+			}
+		}
+	})
+	if !attached {
+		websocket.JSON.Send(ws, &logFrame{Stream: "stderr", Line: fmt.Sprintf("%s is already being monitored", s.Name())})
+		return
+	}
+	go func() {
+		var b [1]byte
+		ws.Read(b[:])
+		done <- true
+	}()
+	<-done
+	s.logger.detachMonitor()
+}
+
+// startHTTPServer starts the HTTP+JSON control API if *httpAddr is set. It
+// listens alongside the existing Unix-socket line protocol served by
+// startServer and shares the same services list and mutex. It blocks until
+// ctx is canceled, at which point it shuts the server down gracefully.
+func startHTTPServer(ctx context.Context) error {
+	if *httpAddr == "" {
+		<-ctx.Done()
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services", handleServices)
+	mux.HandleFunc("/services/", handleService)
+	server := &http.Server{Addr: *httpAddr, Handler: mux}
+	errc := make(chan error, 1)
+	go func() {
+		if *httpTLSCert != "" && *httpTLSKey != "" {
+			errc <- server.ListenAndServeTLS(*httpTLSCert, *httpTLSKey)
+		} else {
+			errc <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		return nil
+	case err := <-errc:
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"gnd.la/log"
+	"sync"
+)
+
+// logger is a service's per-instance log handler. It's what newService
+// attaches to a Service as its logger field, and what every line of
+// stdout/stderr captured from the service's process is written through.
+// A "log" command temporarily installs monitor to tee that output to a
+// connected client (see serveConn's "log" case and serveServiceLogWS);
+// whether or not one is attached, the line is always written to sink too.
+// monitor is guarded by mu rather than set directly, since both the
+// Unix-socket "log" command and the HTTP log WebSocket can race to
+// attach to the same service.
+type logger struct {
+	mu      sync.Mutex
+	sink    Sink
+	monitor func(prefix string, b []byte)
+}
+
+// attachMonitor installs fn as the logger's monitor and returns true, or
+// does nothing and returns false if another monitor is already attached.
+func (l *logger) attachMonitor(fn func(prefix string, b []byte)) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.monitor != nil {
+		return false
+	}
+	l.monitor = fn
+	return true
+}
+
+// detachMonitor removes the logger's monitor.
+func (l *logger) detachMonitor() {
+	l.mu.Lock()
+	l.monitor = nil
+	l.mu.Unlock()
+}
+
+// newLogger builds the per-service logger for serviceName, wiring its
+// Sink from cfg (the service's Log config block, parsed by ParseConfig),
+// defaulting to the historical rotating file under LogDir when cfg is
+// nil.
+func newLogger(serviceName string, cfg *SinkConfig) (*logger, error) {
+	sink, err := newSink(serviceName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &logger{sink: sink}, nil
+}
+
+// Write is called with every line of output captured from the service's
+// process, prefix being "stdout" or "stderr".
+func (l *logger) Write(prefix string, b []byte) {
+	l.mu.Lock()
+	monitor := l.monitor
+	l.mu.Unlock()
+	if monitor != nil {
+		monitor(prefix, b)
+	}
+	if l.sink != nil {
+		if err := l.sink.Write(prefix, b); err != nil {
+			log.Errorf("error writing to log sink: %s", err)
+		}
+	}
+}
+
+// Close releases the logger's Sink, e.g. when a service is removed.
+func (l *logger) Close() error {
+	if l.sink == nil {
+		return nil
+	}
+	return l.sink.Close()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives a single line of output from a service's stdout or stderr,
+// identified by prefix ("stdout" or "stderr"). Implementations must be
+// safe for concurrent use, since stdout and stderr are written from
+// separate goroutines.
+type Sink interface {
+	Write(prefix string, b []byte) error
+	Close() error
+}
+
+// newSink builds the Sink described by cfg for the named service,
+// defaulting to the historical behavior of a single rotating file under
+// LogDir when cfg is empty.
+func newSink(serviceName string, cfg *SinkConfig) (Sink, error) {
+	if cfg == nil || cfg.Type == "" || cfg.Type == "file" {
+		return newFileSink(serviceName, cfg)
+	}
+	switch cfg.Type {
+	case "console":
+		return newConsoleSink(), nil
+	case "syslog":
+		return newSyslogSink(serviceName)
+	}
+	return nil, fmt.Errorf("unknown log sink type %q", cfg.Type)
+}
+
+// SinkConfig configures how a service's output is logged. It's parsed by
+// ParseConfig from the service's configuration file; the zero value keeps
+// today's behavior of a single rotating file under LogDir.
+type SinkConfig struct {
+	Type       string // "file" (default), "console" or "syslog"
+	MaxSize    int    // max size of a log file in MB before it's rotated (file sink only)
+	MaxAge     int    // max age of a rotated log file in days before it's removed (file sink only)
+	MaxBackups int    // max number of rotated log files to keep (file sink only)
+}
+
+const (
+	defaultMaxSize    = 100 // MB
+	defaultMaxAge     = 7   // days
+	defaultMaxBackups = 5
+)
+
+// fileSink writes to a file under LogDir, rotating it once it grows past
+// MaxSize and pruning old backups past MaxAge/MaxBackups, lumberjack-style.
+type fileSink struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int
+	maxAge     int
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileSink(serviceName string, cfg *SinkConfig) (*fileSink, error) {
+	s := &fileSink{
+		path:       filepath.Join(LogDir, serviceName+".log"),
+		maxSize:    defaultMaxSize,
+		maxAge:     defaultMaxAge,
+		maxBackups: defaultMaxBackups,
+	}
+	if cfg != nil {
+		if cfg.MaxSize > 0 {
+			s.maxSize = cfg.MaxSize
+		}
+		if cfg.MaxAge > 0 {
+			s.maxAge = cfg.MaxAge
+		}
+		if cfg.MaxBackups > 0 {
+			s.maxBackups = cfg.MaxBackups
+		}
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = st.Size()
+	return nil
+}
+
+func (s *fileSink) Write(prefix string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(s.maxSize)*1024*1024 <= s.size {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fmt.Fprintf(s.file, "[%s] %s", prefix, b)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	backups, err := filepath.Glob(s.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	backup := fmt.Sprintf("%s.%s", s.path, formatTime(time.Now()))
+	if err := os.Rename(s.path, backup); err != nil {
+		return err
+	}
+	backups = append(backups, backup)
+	pruneBackups(backups, s.maxBackups, s.maxAge)
+	return s.open()
+}
+
+func pruneBackups(backups []string, maxBackups, maxAgeDays int) {
+	cutoff := time.Now().AddDate(0, 0, -maxAgeDays)
+	sort.Strings(backups)
+	keep := backups
+	if maxBackups > 0 && len(keep) > maxBackups {
+		for _, old := range keep[:len(keep)-maxBackups] {
+			os.Remove(old)
+		}
+		keep = keep[len(keep)-maxBackups:]
+	}
+	for _, b := range keep {
+		if st, err := os.Stat(b); err == nil && st.ModTime().Before(cutoff) {
+			os.Remove(b)
+		}
+	}
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// consoleSink passes a service's stdout/stderr through to governator's own
+// stdout/stderr, for running a service in the foreground while debugging.
+type consoleSink struct{}
+
+func newConsoleSink() *consoleSink {
+	return &consoleSink{}
+}
+
+func (consoleSink) Write(prefix string, b []byte) error {
+	var err error
+	if prefix == "stderr" {
+		_, err = os.Stderr.Write(b)
+	} else {
+		_, err = os.Stdout.Write(b)
+	}
+	return err
+}
+
+func (consoleSink) Close() error { return nil }
+
+// syslogSink forwards a service's output to the system logger (syslog or,
+// on systems where syslog is journald-backed, journald).
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(serviceName string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO, AppName+"/"+serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(prefix string, b []byte) error {
+	line := strings.TrimRight(string(b), "\n")
+	if prefix == "stderr" {
+		return s.w.Err(line)
+	}
+	return s.w.Info(line)
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"gnd.la/log"
+	"sync"
+	"time"
+)
+
+// runner is a named, long-running subsystem managed by a supervisor. It
+// must return once ctx is canceled; a non-nil error returned before that
+// happens is treated as a transient failure and restarted.
+type runner func(ctx context.Context) error
+
+// supervisor starts and tracks a set of named goroutines, modeled on
+// syncthing's util.AsService: each runner is passed the supervisor's
+// context, restarts with exponential backoff if it exits
+// with an error before being asked to stop, and is canceled and waited on
+// together with the rest when the supervisor stops. It replaces the old
+// quit-channel pattern previously used by startWatching and startServer.
+type supervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newSupervisor() *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{ctx: ctx, cancel: cancel}
+}
+
+// add starts fn in its own goroutine under name.
+func (s *supervisor) add(name string, fn runner) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		backoff := time.Second
+		for {
+			err := fn(s.ctx)
+			if s.ctx.Err() != nil {
+				log.Debugf("%s exited: %s", name, s.ctx.Err())
+				return
+			}
+			if err == nil {
+				log.Debugf("%s exited without error", name)
+				return
+			}
+			log.Errorf("%s exited with error, restarting in %s: %s", name, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-s.ctx.Done():
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+// stop cancels every registered subsystem and waits for them all to return.
+func (s *supervisor) stop() {
+	s.cancel()
+	s.wg.Wait()
+}